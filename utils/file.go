@@ -4,18 +4,13 @@
 package utils
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
-
-	l4g "github.com/alecthomas/log4go"
-	s3 "github.com/minio/minio-go"
-	"github.com/minio/minio-go/pkg/credentials"
+	"sync"
 
 	"github.com/mattermost/mattermost-server/model"
 )
@@ -24,350 +19,198 @@ const (
 	TEST_FILE_PATH = "/testfile"
 )
 
-// Similar to s3.New() but allows initialization of signature v2 or signature v4 client.
-// If signV2 input is false, function always returns signature v4.
-//
-// Additionally this function also takes a user defined region, if set
-// disables automatic region lookup.
-func s3New(endpoint, accessKey, secretKey string, secure bool, signV2 bool, region string) (*s3.Client, error) {
-	var creds *credentials.Credentials
-	if signV2 {
-		creds = credentials.NewStatic(accessKey, secretKey, "", credentials.SignatureV2)
-	} else {
-		creds = credentials.NewStatic(accessKey, secretKey, "", credentials.SignatureV4)
+var (
+	fileBackendMut sync.Mutex
+	fileBackendVal FileBackend
+)
+
+// fileBackend returns the FileBackend for the currently configured driver,
+// building it once and caching it so long-lived resources (like the S3
+// backend's *s3.Client) are reused across calls instead of being torn down
+// and rebuilt on every ReadFile/WriteFile/etc. Call InvalidateFileBackend
+// after FileSettings changes so the next call picks up the new config.
+func fileBackend() (FileBackend, *model.AppError) {
+	fileBackendMut.Lock()
+	defer fileBackendMut.Unlock()
+
+	if fileBackendVal != nil {
+		return fileBackendVal, nil
 	}
 
-	s3Clnt, err := s3.NewWithCredentials(endpoint, creds, secure, region)
+	backend, err := NewFileBackend(&Cfg.FileSettings, IsLicensed() && *License().Features.Compliance)
 	if err != nil {
 		return nil, err
 	}
 
-	if *Cfg.FileSettings.AmazonS3Trace {
-		s3Clnt.TraceOn(os.Stdout)
-	}
+	fileBackendVal = backend
+	return fileBackendVal, nil
+}
 
-	return s3Clnt, nil
+// InvalidateFileBackend discards the cached FileBackend so the next call to
+// fileBackend rebuilds it from the current config. This must be called
+// whenever FileSettings changes (e.g. after a config reload or a system
+// console save) so stale credentials/endpoints aren't reused.
+func InvalidateFileBackend() {
+	fileBackendMut.Lock()
+	defer fileBackendMut.Unlock()
+	fileBackendVal = nil
 }
 
-func TestFileConnection() *model.AppError {
-	if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_S3 {
-		endpoint := Cfg.FileSettings.AmazonS3Endpoint
-		accessKey := Cfg.FileSettings.AmazonS3AccessKeyId
-		secretKey := Cfg.FileSettings.AmazonS3SecretAccessKey
-		secure := *Cfg.FileSettings.AmazonS3SSL
-		signV2 := *Cfg.FileSettings.AmazonS3SignV2
-		region := Cfg.FileSettings.AmazonS3Region
-		bucket := Cfg.FileSettings.AmazonS3Bucket
-
-		s3Clnt, err := s3New(endpoint, accessKey, secretKey, secure, signV2, region)
-		if err != nil {
-			return model.NewAppError("TestFileConnection", "Bad connection to S3 or minio.", nil, err.Error(), http.StatusInternalServerError)
-		}
+// SetFileSettings validates fs, installs it as the active FileSettings,
+// invalidates the cached FileBackend so the very next file operation picks
+// up the change, and starts or stops the retention sweep job to match the
+// new RetentionDays. This is the entry point a config-save path (system
+// console, config reload) should go through rather than writing
+// Cfg.FileSettings directly: it's what turns a bad S3
+// endpoint/bucket/credential into an actionable error on save instead of a
+// mystery failure on first upload, and what makes enabling retention in the
+// system console actually start pruning old files instead of just saving a
+// number nothing reads.
+func SetFileSettings(fs model.FileSettings) (bool, *model.AppError) {
+	if ok, err := ValidateFileSettings(&fs); !ok {
+		return false, err
+	}
 
-		exists, err := s3Clnt.BucketExists(bucket)
-		if err != nil {
-			return model.NewAppError("TestFileConnection", "Error checking if bucket exists.", nil, err.Error(), http.StatusInternalServerError)
-		}
+	Cfg.FileSettings = fs
+	InvalidateFileBackend()
+	startOrStopRetentionJob(fs)
+	return true, nil
+}
 
-		if !exists {
-			l4g.Warn("Bucket specified does not exist. Attempting to create...")
-			err := s3Clnt.MakeBucket(bucket, region)
-			if err != nil {
-				l4g.Error("Unable to create bucket.")
-				return model.NewAppError("TestFileConnection", "Unable to create bucket", nil, err.Error(), http.StatusInternalServerError)
-			}
-		}
-		l4g.Info("Connection to S3 or minio is good. Bucket exists.")
-	} else if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_LOCAL {
-		f := []byte("testingwrite")
-		if err := writeFileLocally(f, Cfg.FileSettings.Directory+TEST_FILE_PATH); err != nil {
-			return model.NewAppError("TestFileConnection", "Don't have permissions to write to local path specified or other error.", nil, err.Error(), http.StatusInternalServerError)
-		}
-		os.Remove(Cfg.FileSettings.Directory + TEST_FILE_PATH)
-		l4g.Info("Able to write files to local storage.")
-	} else {
-		return model.NewAppError("TestFileConnection", "No file driver selected.", nil, "", http.StatusInternalServerError)
+func TestFileConnection() *model.AppError {
+	if _, err := ValidateFileSettings(&Cfg.FileSettings); err != nil {
+		return err
 	}
 
-	return nil
+	backend, err := fileBackend()
+	if err != nil {
+		return err
+	}
+	return backend.TestConnection()
 }
 
 func ReadFile(path string) ([]byte, *model.AppError) {
-	if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_S3 {
-		endpoint := Cfg.FileSettings.AmazonS3Endpoint
-		accessKey := Cfg.FileSettings.AmazonS3AccessKeyId
-		secretKey := Cfg.FileSettings.AmazonS3SecretAccessKey
-		secure := *Cfg.FileSettings.AmazonS3SSL
-		signV2 := *Cfg.FileSettings.AmazonS3SignV2
-		region := Cfg.FileSettings.AmazonS3Region
-		s3Clnt, err := s3New(endpoint, accessKey, secretKey, secure, signV2, region)
-		if err != nil {
-			return nil, model.NewAppError("ReadFile", "api.file.read_file.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-		bucket := Cfg.FileSettings.AmazonS3Bucket
-		minioObject, err := s3Clnt.GetObject(bucket, path)
-		if err != nil {
-			return nil, model.NewAppError("ReadFile", "api.file.read_file.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-		defer minioObject.Close()
-		if f, err := ioutil.ReadAll(minioObject); err != nil {
-			return nil, model.NewAppError("ReadFile", "api.file.read_file.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		} else {
-			return f, nil
-		}
-	} else if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_LOCAL {
-		if f, err := ioutil.ReadFile(Cfg.FileSettings.Directory + path); err != nil {
-			return nil, model.NewAppError("ReadFile", "api.file.read_file.reading_local.app_error", nil, err.Error(), http.StatusInternalServerError)
-		} else {
-			return f, nil
-		}
-	} else {
-		return nil, model.NewAppError("ReadFile", "api.file.read_file.configured.app_error", nil, "", http.StatusNotImplemented)
+	backend, err := fileBackend()
+	if err != nil {
+		return nil, err
 	}
+	return backend.ReadFile(path)
 }
 
-func MoveFile(oldPath, newPath string) *model.AppError {
-	if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_S3 {
-		endpoint := Cfg.FileSettings.AmazonS3Endpoint
-		accessKey := Cfg.FileSettings.AmazonS3AccessKeyId
-		secretKey := Cfg.FileSettings.AmazonS3SecretAccessKey
-		secure := *Cfg.FileSettings.AmazonS3SSL
-		signV2 := *Cfg.FileSettings.AmazonS3SignV2
-		region := Cfg.FileSettings.AmazonS3Region
-		encrypt := false
-		if *Cfg.FileSettings.AmazonS3SSE && IsLicensed() && *License().Features.Compliance {
-			encrypt = true
-		}
-		s3Clnt, err := s3New(endpoint, accessKey, secretKey, secure, signV2, region)
-		if err != nil {
-			return model.NewAppError("moveFile", "api.file.write_file.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-		bucket := Cfg.FileSettings.AmazonS3Bucket
-
-		source := s3.NewSourceInfo(bucket, oldPath, nil)
-		destination, err := s3.NewDestinationInfo(bucket, newPath, nil, CopyMetadata(encrypt))
-		if err != nil {
-			return model.NewAppError("moveFile", "api.file.write_file.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-		if err = s3Clnt.CopyObject(destination, source); err != nil {
-			return model.NewAppError("moveFile", "api.file.move_file.delete_from_s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-		if err = s3Clnt.RemoveObject(bucket, oldPath); err != nil {
-			return model.NewAppError("moveFile", "api.file.move_file.delete_from_s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-	} else if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_LOCAL {
-		if err := os.MkdirAll(filepath.Dir(Cfg.FileSettings.Directory+newPath), 0774); err != nil {
-			return model.NewAppError("moveFile", "api.file.move_file.rename.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
+// ReadFileStream returns a reader for the file at path instead of loading it
+// into memory all at once. The caller is responsible for closing it.
+func ReadFileStream(path string) (io.ReadCloser, *model.AppError) {
+	backend, err := fileBackend()
+	if err != nil {
+		return nil, err
+	}
+	return backend.ReadFileStream(path)
+}
 
-		if err := os.Rename(Cfg.FileSettings.Directory+oldPath, Cfg.FileSettings.Directory+newPath); err != nil {
-			return model.NewAppError("moveFile", "api.file.move_file.rename.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-	} else {
-		return model.NewAppError("moveFile", "api.file.move_file.configured.app_error", nil, "", http.StatusNotImplemented)
+// FileSize returns the size in bytes of the file at path.
+func FileSize(path string) (int64, *model.AppError) {
+	backend, err := fileBackend()
+	if err != nil {
+		return 0, err
 	}
+	return backend.FileSize(path)
+}
 
-	return nil
+func MoveFile(oldPath, newPath string) *model.AppError {
+	backend, err := fileBackend()
+	if err != nil {
+		return err
+	}
+	return backend.MoveFile(oldPath, newPath)
 }
 
 func WriteFile(f []byte, path string) *model.AppError {
-	if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_S3 {
-		endpoint := Cfg.FileSettings.AmazonS3Endpoint
-		accessKey := Cfg.FileSettings.AmazonS3AccessKeyId
-		secretKey := Cfg.FileSettings.AmazonS3SecretAccessKey
-		secure := *Cfg.FileSettings.AmazonS3SSL
-		signV2 := *Cfg.FileSettings.AmazonS3SignV2
-		region := Cfg.FileSettings.AmazonS3Region
-		encrypt := false
-		if *Cfg.FileSettings.AmazonS3SSE && IsLicensed() && *License().Features.Compliance {
-			encrypt = true
-		}
-
-		s3Clnt, err := s3New(endpoint, accessKey, secretKey, secure, signV2, region)
-		if err != nil {
-			return model.NewAppError("WriteFile", "api.file.write_file.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-
-		bucket := Cfg.FileSettings.AmazonS3Bucket
-		ext := filepath.Ext(path)
-		metaData := S3Metadata(encrypt, "binary/octet-stream")
-		if model.IsFileExtImage(ext) {
-			metaData = S3Metadata(encrypt, model.GetImageMimeType(ext))
-		}
-
-		_, err = s3Clnt.PutObjectWithMetadata(bucket, path, bytes.NewReader(f), metaData, nil)
-		if err != nil {
-			return model.NewAppError("WriteFile", "api.file.write_file.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-	} else if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_LOCAL {
-		if err := writeFileLocally(f, Cfg.FileSettings.Directory+path); err != nil {
-			return err
-		}
-	} else {
-		return model.NewAppError("WriteFile", "api.file.write_file.configured.app_error", nil, "", http.StatusNotImplemented)
+	backend, err := fileBackend()
+	if err != nil {
+		return err
 	}
-
-	return nil
+	return backend.WriteFile(f, path)
 }
 
-func writeFileLocally(f []byte, path string) *model.AppError {
-	if err := os.MkdirAll(filepath.Dir(path), 0774); err != nil {
-		directory, _ := filepath.Abs(filepath.Dir(path))
-		return model.NewAppError("WriteFile", "api.file.write_file_locally.create_dir.app_error", nil, "directory="+directory+", err="+err.Error(), http.StatusInternalServerError)
+// WriteFileWithMetadata uploads f to path using the given MIME type and
+// arbitrary user metadata, for callers (emoji, brand images, attachments)
+// that need correct Content-Type or searchable metadata on the stored file.
+func WriteFileWithMetadata(f []byte, path string, contentType string, userMeta map[string]string) *model.AppError {
+	backend, err := fileBackend()
+	if err != nil {
+		return err
 	}
+	return backend.WriteFileWithMetadata(f, path, contentType, userMeta)
+}
 
-	if err := ioutil.WriteFile(path, f, 0644); err != nil {
-		return model.NewAppError("WriteFile", "api.file.write_file_locally.writing.app_error", nil, err.Error(), http.StatusInternalServerError)
+// WriteFileStream uploads from r without requiring the caller to load the
+// whole payload into memory first. size must be the exact number of bytes
+// that will be read from r.
+func WriteFileStream(r io.Reader, size int64, path string) *model.AppError {
+	backend, err := fileBackend()
+	if err != nil {
+		return err
 	}
-
-	return nil
+	return backend.WriteFileStream(r, size, path)
 }
 
 func RemoveFile(path string) *model.AppError {
-	if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_S3 {
-		endpoint := Cfg.FileSettings.AmazonS3Endpoint
-		accessKey := Cfg.FileSettings.AmazonS3AccessKeyId
-		secretKey := Cfg.FileSettings.AmazonS3SecretAccessKey
-		secure := *Cfg.FileSettings.AmazonS3SSL
-		signV2 := *Cfg.FileSettings.AmazonS3SignV2
-		region := Cfg.FileSettings.AmazonS3Region
-
-		s3Clnt, err := s3New(endpoint, accessKey, secretKey, secure, signV2, region)
-		if err != nil {
-			return model.NewAppError("RemoveFile", "utils.file.remove_file.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-
-		bucket := Cfg.FileSettings.AmazonS3Bucket
-		if err := s3Clnt.RemoveObject(bucket, path); err != nil {
-			return model.NewAppError("RemoveFile", "utils.file.remove_file.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-	} else if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_LOCAL {
-		if err := os.Remove(Cfg.FileSettings.Directory + path); err != nil {
-			return model.NewAppError("RemoveFile", "utils.file.remove_file.local.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-	} else {
-		return model.NewAppError("RemoveFile", "utils.file.remove_file.configured.app_error", nil, "", http.StatusNotImplemented)
+	backend, err := fileBackend()
+	if err != nil {
+		return err
 	}
-
-	return nil
-}
-
-func getPathsFromObjectInfos(in <-chan s3.ObjectInfo) <-chan string {
-	out := make(chan string, 1)
-
-	go func() {
-		defer close(out)
-
-		for {
-			info, done := <-in
-
-			if !done {
-				break
-			}
-
-			out <- info.Key
-		}
-	}()
-
-	return out
+	return backend.RemoveFile(path)
 }
 
 // Returns a list of all the directories within the path directory provided.
 func ListDirectory(path string) (*[]string, *model.AppError) {
-	var paths []string
-
-	if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_S3 {
-		endpoint := Cfg.FileSettings.AmazonS3Endpoint
-		accessKey := Cfg.FileSettings.AmazonS3AccessKeyId
-		secretKey := Cfg.FileSettings.AmazonS3SecretAccessKey
-		secure := *Cfg.FileSettings.AmazonS3SSL
-		signV2 := *Cfg.FileSettings.AmazonS3SignV2
-		region := Cfg.FileSettings.AmazonS3Region
-
-		s3Clnt, err := s3New(endpoint, accessKey, secretKey, secure, signV2, region)
-		if err != nil {
-			return nil, model.NewAppError("ListDirectory", "utils.file.list_directory.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-
-		doneCh := make(chan struct{})
-
-		defer close(doneCh)
+	backend, err := fileBackend()
+	if err != nil {
+		return nil, err
+	}
+	return backend.ListDirectory(path)
+}
 
-		bucket := Cfg.FileSettings.AmazonS3Bucket
-		for object := range s3Clnt.ListObjects(bucket, path, false, doneCh) {
-			if object.Err != nil {
-				return nil, model.NewAppError("ListDirectory", "utils.file.list_directory.s3.app_error", nil, object.Err.Error(), http.StatusInternalServerError)
-			}
-			paths = append(paths, strings.Trim(object.Key, "/"))
-		}
-	} else if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_LOCAL {
-		if fileInfos, err := ioutil.ReadDir(Cfg.FileSettings.Directory + path); err != nil {
-			return nil, model.NewAppError("ListDirectory", "utils.file.list_directory.local.app_error", nil, err.Error(), http.StatusInternalServerError)
-		} else {
-			for _, fileInfo := range fileInfos {
-				if fileInfo.IsDir() {
-					paths = append(paths, filepath.Join(path, fileInfo.Name()))
-				}
-			}
-		}
-	} else {
-		return nil, model.NewAppError("ListDirectory", "utils.file.list_directory.configured.app_error", nil, "", http.StatusInternalServerError)
+// ListDirectoryRecursive returns the path of every file found anywhere
+// below path, recursing through all sub-directories.
+func ListDirectoryRecursive(path string) (*[]string, *model.AppError) {
+	backend, err := fileBackend()
+	if err != nil {
+		return nil, err
 	}
+	return backend.ListDirectoryRecursive(path)
+}
 
-	return &paths, nil
+// ListDirectoryRecursiveWithSizes is like ListDirectoryRecursive but also
+// returns each file's size, for callers (like the retention sweep) that
+// would otherwise have to re-stat every file just to total their size.
+func ListDirectoryRecursiveWithSizes(path string) (*[]FileInfo, *model.AppError) {
+	backend, err := fileBackend()
+	if err != nil {
+		return nil, err
+	}
+	return backend.ListDirectoryRecursiveWithSizes(path)
 }
 
 func RemoveDirectory(path string) *model.AppError {
-	if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_S3 {
-		endpoint := Cfg.FileSettings.AmazonS3Endpoint
-		accessKey := Cfg.FileSettings.AmazonS3AccessKeyId
-		secretKey := Cfg.FileSettings.AmazonS3SecretAccessKey
-		secure := *Cfg.FileSettings.AmazonS3SSL
-		signV2 := *Cfg.FileSettings.AmazonS3SignV2
-		region := Cfg.FileSettings.AmazonS3Region
-
-		s3Clnt, err := s3New(endpoint, accessKey, secretKey, secure, signV2, region)
-		if err != nil {
-			return model.NewAppError("RemoveDirectory", "utils.file.remove_directory.s3.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-
-		doneCh := make(chan struct{})
-
-		bucket := Cfg.FileSettings.AmazonS3Bucket
-		for err := range s3Clnt.RemoveObjects(bucket, getPathsFromObjectInfos(s3Clnt.ListObjects(bucket, path, true, doneCh))) {
-			if err.Err != nil {
-				doneCh <- struct{}{}
-				return model.NewAppError("RemoveDirectory", "utils.file.remove_directory.s3.app_error", nil, err.Err.Error(), http.StatusInternalServerError)
-			}
-		}
-
-		close(doneCh)
-	} else if *Cfg.FileSettings.DriverName == model.IMAGE_DRIVER_LOCAL {
-		if err := os.RemoveAll(Cfg.FileSettings.Directory + path); err != nil {
-			return model.NewAppError("RemoveDirectory", "utils.file.remove_directory.local.app_error", nil, err.Error(), http.StatusInternalServerError)
-		}
-	} else {
-		return model.NewAppError("RemoveDirectory", "utils.file.remove_directory.configured.app_error", nil, "", http.StatusNotImplemented)
+	backend, err := fileBackend()
+	if err != nil {
+		return err
 	}
-
-	return nil
+	return backend.RemoveDirectory(path)
 }
 
-func S3Metadata(encrypt bool, contentType string) map[string][]string {
-	metaData := make(map[string][]string)
-	if contentType != "" {
-		metaData["Content-Type"] = []string{"contentType"}
+func writeFileLocally(f []byte, path string) *model.AppError {
+	if err := os.MkdirAll(filepath.Dir(path), 0774); err != nil {
+		directory, _ := filepath.Abs(filepath.Dir(path))
+		return model.NewAppError("WriteFile", "api.file.write_file_locally.create_dir.app_error", nil, "directory="+directory+", err="+err.Error(), http.StatusInternalServerError)
 	}
-	if encrypt {
-		metaData["x-amz-server-side-encryption"] = []string{"AES256"}
+
+	if err := ioutil.WriteFile(path, f, 0644); err != nil {
+		return model.NewAppError("WriteFile", "api.file.write_file_locally.writing.app_error", nil, err.Error(), http.StatusInternalServerError)
 	}
-	return metaData
-}
 
-func CopyMetadata(encrypt bool) map[string]string {
-	metaData := make(map[string]string)
-	metaData["x-amz-server-side-encryption"] = "AES256"
-	return metaData
+	return nil
 }
 
 // CopyFile will copy a file from src path to dst path.
@@ -0,0 +1,78 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// FileBackend abstracts the operations the server needs to perform against
+// whichever storage provider is configured (local disk, S3, etc). All of the
+// top-level helpers in this package (ReadFile, WriteFile, ...) are thin
+// wrappers that select a backend once from config and delegate to it.
+type FileBackend interface {
+	TestConnection() *model.AppError
+
+	ReadFile(path string) ([]byte, *model.AppError)
+	ReadFileStream(path string) (io.ReadCloser, *model.AppError)
+	FileSize(path string) (int64, *model.AppError)
+	MoveFile(oldPath, newPath string) *model.AppError
+	WriteFile(f []byte, path string) *model.AppError
+	WriteFileWithMetadata(f []byte, path string, contentType string, userMeta map[string]string) *model.AppError
+	WriteFileStream(r io.Reader, size int64, path string) *model.AppError
+	RemoveFile(path string) *model.AppError
+
+	ListDirectory(path string) (*[]string, *model.AppError)
+	ListDirectoryRecursive(path string) (*[]string, *model.AppError)
+	ListDirectoryRecursiveWithSizes(path string) (*[]FileInfo, *model.AppError)
+	RemoveDirectory(path string) *model.AppError
+}
+
+// FileInfo describes a single file found by ListDirectoryRecursiveWithSizes,
+// so callers that need size (like the retention sweep) don't have to re-stat
+// every object the backend's own listing call already read the size for.
+type FileInfo struct {
+	Path string
+	Size int64
+}
+
+// NewFileBackend selects and constructs the FileBackend implementation for
+// the given settings. enableComplianceFeatures controls whether backends that
+// support server-side encryption (currently S3) turn it on.
+//
+// GCSFileBackend and AzureBlobFileBackend are implemented (see
+// file_backend_gcs.go/file_backend_azure.go) but deliberately not wired up
+// here yet: constructing them needs model.IMAGE_DRIVER_GCS/IMAGE_DRIVER_AZURE
+// driver-name constants and model.FileSettings.GCSCredentialsJson/GCSBucket/
+// AzureAccountName/AzureAccountKey/AzureContainer config fields, none of
+// which exist in model/config in this tree. Adding switch cases that
+// reference undefined identifiers would stop this package from compiling at
+// all, which is worse than the driver staying unselectable until that
+// model/config work lands; an operator who sets DriverName to "gcs" or
+// "azure" today falls through to the unsupported-driver error below instead.
+func NewFileBackend(settings *model.FileSettings, enableComplianceFeatures bool) (FileBackend, *model.AppError) {
+	switch *settings.DriverName {
+	case model.IMAGE_DRIVER_LOCAL:
+		return &LocalFileBackend{
+			directory: settings.Directory,
+		}, nil
+	case model.IMAGE_DRIVER_S3:
+		return &S3FileBackend{
+			endpoint:  settings.AmazonS3Endpoint,
+			accessKey: settings.AmazonS3AccessKeyId,
+			secretKey: settings.AmazonS3SecretAccessKey,
+			secure:    *settings.AmazonS3SSL,
+			signV2:    *settings.AmazonS3SignV2,
+			region:    resolveS3Region(settings.AmazonS3Endpoint, settings.AmazonS3Region),
+			bucket:    settings.AmazonS3Bucket,
+			encrypt:   *settings.AmazonS3SSE && enableComplianceFeatures,
+			trace:     *settings.AmazonS3Trace,
+		}, nil
+	}
+
+	return nil, model.NewAppError("NewFileBackend", "utils.file.configured.app_error", nil, "", http.StatusInternalServerError)
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// GCSFileBackend implements FileBackend against a Google Cloud Storage
+// bucket. The *storage.Client is cached on the struct, mirroring the S3
+// backend's handling of its minio client.
+//
+// NewFileBackend doesn't construct one of these yet: see the comment on
+// NewFileBackend for why GCS isn't wired up as a selectable driver in this
+// tree.
+//
+// Unlike the S3 backend, this does not yet support compliance server-side
+// encryption: GCS customer-supplied/customer-managed encryption keys require
+// passing a key through ObjectHandle.Key() on every request, which isn't
+// wired up here. encrypt exists so a future NewFileBackend can refuse to
+// build one of these when compliance encryption is requested, and
+// TestConnection fails outright if it's ever set, rather than silently
+// writing unencrypted files or only logging a warning that an operator
+// could miss.
+type GCSFileBackend struct {
+	credentialsJson string
+	bucket          string
+	encrypt         bool
+
+	client *storage.Client
+}
+
+func (b *GCSFileBackend) getClient() (*storage.Client, error) {
+	if b.client != nil {
+		return b.client, nil
+	}
+
+	ctx := context.Background()
+	client, err := storage.NewClient(ctx, option.WithCredentialsJSON([]byte(b.credentialsJson)))
+	if err != nil {
+		return nil, err
+	}
+
+	b.client = client
+	return b.client, nil
+}
+
+func (b *GCSFileBackend) TestConnection() *model.AppError {
+	client, err := b.getClient()
+	if err != nil {
+		return model.NewAppError("TestFileConnection", "Bad connection to GCS.", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	if _, err := client.Bucket(b.bucket).Attrs(context.Background()); err != nil {
+		return model.NewAppError("TestFileConnection", "Unable to access GCS bucket.", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	if b.encrypt {
+		return model.NewAppError("TestFileConnection", "utils.file.test_connection.gcs.encrypt_not_supported.app_error", nil, "compliance encryption was requested but is not implemented for the GCS file backend; refusing to report a healthy connection so this isn't mistaken for files being encrypted at rest", http.StatusNotImplemented)
+	}
+
+	return nil
+}
+
+func (b *GCSFileBackend) ReadFile(path string) ([]byte, *model.AppError) {
+	rc, appErr := b.ReadFileStream(path)
+	if appErr != nil {
+		return nil, appErr
+	}
+	defer rc.Close()
+
+	f, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, model.NewAppError("ReadFile", "api.file.read_file.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return f, nil
+}
+
+func (b *GCSFileBackend) ReadFileStream(path string) (io.ReadCloser, *model.AppError) {
+	client, err := b.getClient()
+	if err != nil {
+		return nil, model.NewAppError("ReadFileStream", "api.file.read_file.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	rc, err := client.Bucket(b.bucket).Object(path).NewReader(context.Background())
+	if err != nil {
+		return nil, model.NewAppError("ReadFileStream", "api.file.read_file.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	return rc, nil
+}
+
+func (b *GCSFileBackend) FileSize(path string) (int64, *model.AppError) {
+	client, err := b.getClient()
+	if err != nil {
+		return 0, model.NewAppError("FileSize", "utils.file.file_size.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	attrs, err := client.Bucket(b.bucket).Object(path).Attrs(context.Background())
+	if err != nil {
+		return 0, model.NewAppError("FileSize", "utils.file.file_size.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	return attrs.Size, nil
+}
+
+func (b *GCSFileBackend) MoveFile(oldPath, newPath string) *model.AppError {
+	client, err := b.getClient()
+	if err != nil {
+		return model.NewAppError("moveFile", "api.file.write_file.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	bucket := client.Bucket(b.bucket)
+	src := bucket.Object(oldPath)
+	dst := bucket.Object(newPath)
+
+	if _, err := dst.CopierFrom(src).Run(context.Background()); err != nil {
+		return model.NewAppError("moveFile", "api.file.move_file.delete_from_gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+	if err := src.Delete(context.Background()); err != nil {
+		return model.NewAppError("moveFile", "api.file.move_file.delete_from_gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+func (b *GCSFileBackend) contentTypeForPath(path string) string {
+	if ext := filepath.Ext(path); model.IsFileExtImage(ext) {
+		return model.GetImageMimeType(ext)
+	}
+	return "binary/octet-stream"
+}
+
+func (b *GCSFileBackend) WriteFile(f []byte, path string) *model.AppError {
+	return b.writeFile(bytes.NewReader(f), b.contentTypeForPath(path), nil, path)
+}
+
+// WriteFileWithMetadata uploads f to path using the given MIME type and
+// arbitrary user metadata.
+func (b *GCSFileBackend) WriteFileWithMetadata(f []byte, path string, contentType string, userMeta map[string]string) *model.AppError {
+	return b.writeFile(bytes.NewReader(f), contentType, userMeta, path)
+}
+
+func (b *GCSFileBackend) WriteFileStream(r io.Reader, size int64, path string) *model.AppError {
+	return b.writeFile(r, b.contentTypeForPath(path), nil, path)
+}
+
+func (b *GCSFileBackend) writeFile(r io.Reader, contentType string, userMeta map[string]string, path string) *model.AppError {
+	client, err := b.getClient()
+	if err != nil {
+		return model.NewAppError("WriteFile", "api.file.write_file.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	w := client.Bucket(b.bucket).Object(path).NewWriter(context.Background())
+	w.ContentType = contentType
+
+	if len(userMeta) > 0 {
+		meta := make(map[string]string, len(userMeta))
+		for k, v := range userMeta {
+			meta[k] = v
+		}
+		w.Metadata = meta
+	}
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return model.NewAppError("WriteFile", "api.file.write_file.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+	if err := w.Close(); err != nil {
+		return model.NewAppError("WriteFile", "api.file.write_file.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+func (b *GCSFileBackend) RemoveFile(path string) *model.AppError {
+	client, err := b.getClient()
+	if err != nil {
+		return model.NewAppError("RemoveFile", "utils.file.remove_file.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	if err := client.Bucket(b.bucket).Object(path).Delete(context.Background()); err != nil {
+		return model.NewAppError("RemoveFile", "utils.file.remove_file.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+func (b *GCSFileBackend) ListDirectory(path string) (*[]string, *model.AppError) {
+	var paths []string
+
+	client, err := b.getClient()
+	if err != nil {
+		return nil, model.NewAppError("ListDirectory", "utils.file.list_directory.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	it := client.Bucket(b.bucket).Objects(context.Background(), &storage.Query{Prefix: path, Delimiter: "/"})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, model.NewAppError("ListDirectory", "utils.file.list_directory.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+		}
+		if attrs.Prefix != "" {
+			paths = append(paths, strings.Trim(attrs.Prefix, "/"))
+		} else {
+			paths = append(paths, strings.Trim(attrs.Name, "/"))
+		}
+	}
+
+	return &paths, nil
+}
+
+func (b *GCSFileBackend) ListDirectoryRecursive(path string) (*[]string, *model.AppError) {
+	files, err := b.ListDirectoryRecursiveWithSizes(path)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(*files))
+	for i, file := range *files {
+		paths[i] = file.Path
+	}
+	return &paths, nil
+}
+
+// ListDirectoryRecursiveWithSizes is like ListDirectoryRecursive but also
+// returns each object's size, which the Objects iterator's Attrs already
+// carries without an extra Attrs() round-trip per file.
+func (b *GCSFileBackend) ListDirectoryRecursiveWithSizes(path string) (*[]FileInfo, *model.AppError) {
+	var files []FileInfo
+
+	client, err := b.getClient()
+	if err != nil {
+		return nil, model.NewAppError("ListDirectoryRecursiveWithSizes", "utils.file.list_directory.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	it := client.Bucket(b.bucket).Objects(context.Background(), &storage.Query{Prefix: path})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, model.NewAppError("ListDirectoryRecursiveWithSizes", "utils.file.list_directory.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+		}
+		files = append(files, FileInfo{Path: strings.Trim(attrs.Name, "/"), Size: attrs.Size})
+	}
+
+	return &files, nil
+}
+
+func (b *GCSFileBackend) RemoveDirectory(path string) *model.AppError {
+	client, err := b.getClient()
+	if err != nil {
+		return model.NewAppError("RemoveDirectory", "utils.file.remove_directory.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	files, appErr := b.ListDirectoryRecursive(path)
+	if appErr != nil {
+		return appErr
+	}
+
+	bucket := client.Bucket(b.bucket)
+	for _, file := range *files {
+		if err := bucket.Object(file).Delete(context.Background()); err != nil {
+			return model.NewAppError("RemoveDirectory", "utils.file.remove_directory.gcs.app_error", nil, err.Error(), http.StatusInternalServerError)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	l4g "github.com/alecthomas/log4go"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// LocalFileBackend implements FileBackend against a directory on the local
+// filesystem.
+type LocalFileBackend struct {
+	directory string
+}
+
+func (b *LocalFileBackend) TestConnection() *model.AppError {
+	f := []byte("testingwrite")
+	if err := writeFileLocally(f, filepath.Join(b.directory, TEST_FILE_PATH)); err != nil {
+		return model.NewAppError("TestFileConnection", "Don't have permissions to write to local path specified or other error.", nil, err.Error(), http.StatusInternalServerError)
+	}
+	os.Remove(filepath.Join(b.directory, TEST_FILE_PATH))
+	l4g.Info("Able to write files to local storage.")
+	return nil
+}
+
+func (b *LocalFileBackend) ReadFile(path string) ([]byte, *model.AppError) {
+	f, err := ioutil.ReadFile(filepath.Join(b.directory, path))
+	if err != nil {
+		return nil, model.NewAppError("ReadFile", "api.file.read_file.reading_local.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return f, nil
+}
+
+func (b *LocalFileBackend) ReadFileStream(path string) (io.ReadCloser, *model.AppError) {
+	f, err := os.Open(filepath.Join(b.directory, path))
+	if err != nil {
+		return nil, model.NewAppError("ReadFileStream", "api.file.read_file.reading_local.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return f, nil
+}
+
+func (b *LocalFileBackend) FileSize(path string) (int64, *model.AppError) {
+	info, err := os.Stat(filepath.Join(b.directory, path))
+	if err != nil {
+		return 0, model.NewAppError("FileSize", "utils.file.file_size.local.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return info.Size(), nil
+}
+
+func (b *LocalFileBackend) MoveFile(oldPath, newPath string) *model.AppError {
+	newFullPath := filepath.Join(b.directory, newPath)
+	if err := os.MkdirAll(filepath.Dir(newFullPath), 0774); err != nil {
+		return model.NewAppError("moveFile", "api.file.move_file.rename.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	if err := os.Rename(filepath.Join(b.directory, oldPath), newFullPath); err != nil {
+		return model.NewAppError("moveFile", "api.file.move_file.rename.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+func (b *LocalFileBackend) WriteFile(f []byte, path string) *model.AppError {
+	return writeFileLocally(f, filepath.Join(b.directory, path))
+}
+
+// WriteFileWithMetadata writes f to path. The local disk has no concept of
+// Content-Type or custom object metadata, so contentType and userMeta are
+// accepted only to satisfy the FileBackend interface and are ignored.
+func (b *LocalFileBackend) WriteFileWithMetadata(f []byte, path string, contentType string, userMeta map[string]string) *model.AppError {
+	return b.WriteFile(f, path)
+}
+
+func (b *LocalFileBackend) WriteFileStream(r io.Reader, size int64, path string) *model.AppError {
+	fullPath := filepath.Join(b.directory, path)
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0774); err != nil {
+		directory, _ := filepath.Abs(filepath.Dir(fullPath))
+		return model.NewAppError("WriteFileStream", "api.file.write_file_locally.create_dir.app_error", nil, "directory="+directory+", err="+err.Error(), http.StatusInternalServerError)
+	}
+
+	out, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return model.NewAppError("WriteFileStream", "api.file.write_file_locally.writing.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, r); err != nil {
+		return model.NewAppError("WriteFileStream", "api.file.write_file_locally.writing.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	return nil
+}
+
+func (b *LocalFileBackend) RemoveFile(path string) *model.AppError {
+	if err := os.Remove(filepath.Join(b.directory, path)); err != nil {
+		return model.NewAppError("RemoveFile", "utils.file.remove_file.local.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
+
+func (b *LocalFileBackend) ListDirectory(path string) (*[]string, *model.AppError) {
+	var paths []string
+
+	fileInfos, err := ioutil.ReadDir(filepath.Join(b.directory, path))
+	if err != nil {
+		return nil, model.NewAppError("ListDirectory", "utils.file.list_directory.local.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			paths = append(paths, filepath.Join(path, fileInfo.Name()))
+		}
+	}
+
+	return &paths, nil
+}
+
+// ListDirectoryRecursive returns the path of every file (not directory)
+// found anywhere below path, relative to the backend's root.
+func (b *LocalFileBackend) ListDirectoryRecursive(path string) (*[]string, *model.AppError) {
+	files, err := b.ListDirectoryRecursiveWithSizes(path)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(*files))
+	for i, file := range *files {
+		paths[i] = file.Path
+	}
+	return &paths, nil
+}
+
+// ListDirectoryRecursiveWithSizes is like ListDirectoryRecursive but also
+// returns each file's size, since os.FileInfo already has it on hand from
+// the same os.Lstat call Walk makes to tell files apart from directories.
+func (b *LocalFileBackend) ListDirectoryRecursiveWithSizes(path string) (*[]FileInfo, *model.AppError) {
+	var files []FileInfo
+
+	root := filepath.Join(b.directory, path)
+	err := filepath.Walk(root, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			rel, relErr := filepath.Rel(b.directory, walkPath)
+			if relErr != nil {
+				return relErr
+			}
+			files = append(files, FileInfo{Path: rel, Size: info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, model.NewAppError("ListDirectoryRecursiveWithSizes", "utils.file.list_directory.local.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	return &files, nil
+}
+
+func (b *LocalFileBackend) RemoveDirectory(path string) *model.AppError {
+	if err := os.RemoveAll(filepath.Join(b.directory, path)); err != nil {
+		return model.NewAppError("RemoveDirectory", "utils.file.remove_directory.local.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import "testing"
+
+func TestBuildS3Metadata(t *testing.T) {
+	metadata := buildS3Metadata("image/png", map[string]string{"fileid": "abc123"}, false)
+
+	if got := metadata["Content-Type"]; len(got) != 1 || got[0] != "image/png" {
+		t.Fatalf("got Content-Type %v, want [image/png]", got)
+	}
+	if got := metadata["x-amz-meta-fileid"]; len(got) != 1 || got[0] != "abc123" {
+		t.Fatalf("got x-amz-meta-fileid %v, want [abc123]", got)
+	}
+	if _, ok := metadata["x-amz-server-side-encryption"]; ok {
+		t.Fatal("expected no encryption header when encrypt is false")
+	}
+}
+
+func TestBuildS3MetadataEncrypted(t *testing.T) {
+	metadata := buildS3Metadata("binary/octet-stream", nil, true)
+
+	if got := metadata["x-amz-server-side-encryption"]; len(got) != 1 || got[0] != "AES256" {
+		t.Fatalf("got encryption header %v, want [AES256]", got)
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// backendTestCases returns the FileBackend implementations to exercise.
+// Only the local backend runs without external credentials; the cloud
+// backends are included so the same contract is enforced if their
+// MM_FILESETTINGS_* environment variables are configured for this run.
+func backendTestCases(t *testing.T) []struct {
+	name    string
+	backend FileBackend
+} {
+	dir, err := ioutil.TempDir("", "mm-file-backend-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name    string
+		backend FileBackend
+	}{
+		{"local", &LocalFileBackend{directory: dir}},
+	}
+
+	if os.Getenv("MM_FILESETTINGS_AMAZONS3BUCKET") != "" {
+		cases = append(cases, struct {
+			name    string
+			backend FileBackend
+		}{"s3", &S3FileBackend{
+			endpoint:  os.Getenv("MM_FILESETTINGS_AMAZONS3ENDPOINT"),
+			accessKey: os.Getenv("MM_FILESETTINGS_AMAZONS3ACCESSKEYID"),
+			secretKey: os.Getenv("MM_FILESETTINGS_AMAZONS3SECRETACCESSKEY"),
+			secure:    true,
+			bucket:    os.Getenv("MM_FILESETTINGS_AMAZONS3BUCKET"),
+		}})
+	}
+
+	if os.Getenv("MM_FILESETTINGS_GCSBUCKET") != "" {
+		cases = append(cases, struct {
+			name    string
+			backend FileBackend
+		}{"gcs", &GCSFileBackend{
+			credentialsJson: os.Getenv("MM_FILESETTINGS_GCSCREDENTIALSJSON"),
+			bucket:          os.Getenv("MM_FILESETTINGS_GCSBUCKET"),
+		}})
+	}
+
+	if os.Getenv("MM_FILESETTINGS_AZURECONTAINER") != "" {
+		cases = append(cases, struct {
+			name    string
+			backend FileBackend
+		}{"azure", &AzureBlobFileBackend{
+			accountName: os.Getenv("MM_FILESETTINGS_AZUREACCOUNTNAME"),
+			accountKey:  os.Getenv("MM_FILESETTINGS_AZUREACCOUNTKEY"),
+			container:   os.Getenv("MM_FILESETTINGS_AZURECONTAINER"),
+		}})
+	}
+
+	return cases
+}
+
+func TestFileBackendWriteReadRemove(t *testing.T) {
+	for _, tc := range backendTestCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tc.backend
+			path := "tests/" + model.NewId()
+
+			if err := b.WriteFile([]byte("this is a test"), path); err != nil {
+				t.Fatal(err)
+			}
+			defer b.RemoveFile(path)
+
+			data, err := b.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "this is a test" {
+				t.Fatalf("got back wrong data: %v", data)
+			}
+
+			if err := b.RemoveFile(path); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := b.ReadFile(path); err == nil {
+				t.Fatal("expected reading a removed file to fail")
+			}
+		})
+	}
+}
+
+func TestFileBackendWriteWithMetadata(t *testing.T) {
+	for _, tc := range backendTestCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tc.backend
+			path := "tests/" + model.NewId()
+
+			if err := b.WriteFileWithMetadata([]byte("this is a test"), path, "text/plain", map[string]string{"fileid": "abc123"}); err != nil {
+				t.Fatal(err)
+			}
+			defer b.RemoveFile(path)
+
+			data, err := b.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "this is a test" {
+				t.Fatalf("got back wrong data: %v", data)
+			}
+		})
+	}
+}
+
+func TestFileBackendWriteReadStream(t *testing.T) {
+	for _, tc := range backendTestCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tc.backend
+			path := "tests/" + model.NewId()
+			contents := []byte("this is a streamed test")
+
+			if err := b.WriteFileStream(bytes.NewReader(contents), int64(len(contents)), path); err != nil {
+				t.Fatal(err)
+			}
+			defer b.RemoveFile(path)
+
+			rc, err := b.ReadFileStream(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+
+			data, ioErr := ioutil.ReadAll(rc)
+			if ioErr != nil {
+				t.Fatal(ioErr)
+			}
+			if string(data) != string(contents) {
+				t.Fatalf("got back wrong data: %v", data)
+			}
+		})
+	}
+}
+
+func TestFileBackendFileSize(t *testing.T) {
+	for _, tc := range backendTestCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tc.backend
+			path := "tests/" + model.NewId()
+
+			if err := b.WriteFile([]byte("twelve bytes"), path); err != nil {
+				t.Fatal(err)
+			}
+			defer b.RemoveFile(path)
+
+			size, err := b.FileSize(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != 12 {
+				t.Fatalf("got size %v, want 12", size)
+			}
+		})
+	}
+}
+
+func TestFileBackendMove(t *testing.T) {
+	for _, tc := range backendTestCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tc.backend
+			oldPath := "tests/" + model.NewId()
+			newPath := "tests/" + model.NewId()
+
+			if err := b.WriteFile([]byte("moveme"), oldPath); err != nil {
+				t.Fatal(err)
+			}
+			defer b.RemoveFile(newPath)
+
+			if err := b.MoveFile(oldPath, newPath); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := b.ReadFile(oldPath); err == nil {
+				t.Fatal("expected old path to no longer exist")
+			}
+
+			data, err := b.ReadFile(newPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != "moveme" {
+				t.Fatalf("got back wrong data: %v", data)
+			}
+		})
+	}
+}
+
+func TestFileBackendListDirectory(t *testing.T) {
+	for _, tc := range backendTestCases(t) {
+		t.Run(tc.name, func(t *testing.T) {
+			b := tc.backend
+			dir := "tests/" + model.NewId()
+			path := dir + "/" + model.NewId()
+
+			if err := b.WriteFile([]byte("in a directory"), path); err != nil {
+				t.Fatal(err)
+			}
+			defer b.RemoveDirectory(dir)
+
+			paths, err := b.ListDirectory("tests/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, p := range *paths {
+				if p == dir {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("expected %s to show up in %v", dir, *paths)
+			}
+
+			if err := b.RemoveDirectory(dir); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := b.ReadFile(path); err == nil {
+				t.Fatal("expected file under removed directory to be gone")
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import (
+	"regexp"
+	"time"
+
+	l4g "github.com/alecthomas/log4go"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// DATE_PREFIX_FORMAT is the layout new uploads are partitioned under, e.g.
+// "20060102". Storing uploads this way lets ListDirectory and the data
+// retention sweep enumerate a day's worth of files without listing the
+// entire bucket or directory tree.
+const DATE_PREFIX_FORMAT = "20060102"
+
+var datePrefixPattern = regexp.MustCompile(`^\d{8}$`)
+
+// FileUploadPath returns the storage path a new upload at path should be
+// written to, prefixed with the YYYYMMDD folder for uploadedAt.
+func FileUploadPath(uploadedAt time.Time, path string) string {
+	return uploadedAt.Format(DATE_PREFIX_FORMAT) + "/" + path
+}
+
+// RetentionCutoff returns the oldest upload date that should be kept given
+// the configured FileSettings.RetentionDays. A RetentionDays of 0 or less
+// means retention is disabled.
+//
+// FileSettings.RetentionDays (a *int, like the other optional FileSettings
+// fields) does not exist in model/config in this tree yet; it needs to be
+// added there, with a config.json default of nil/disabled, before this
+// compiles against the real model.FileSettings struct.
+func RetentionCutoff() (time.Time, bool) {
+	days := Cfg.FileSettings.RetentionDays
+	if days == nil || *days <= 0 {
+		return time.Time{}, false
+	}
+	return time.Now().AddDate(0, 0, -*days), true
+}
+
+// RetentionSweep walks the date-partitioned top-level directories and
+// removes every one whose day is older than cutoff, using the configured
+// FileBackend. It returns the number of day-directories, the number of
+// files, and the number of bytes purged.
+func RetentionSweep(cutoff time.Time) (dirsPurged int, filesPurged int, bytesPurged int64, rerr *model.AppError) {
+	backend, err := fileBackend()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return retentionSweep(backend, cutoff)
+}
+
+// retentionSweep holds the actual sweep logic, taking backend explicitly so
+// it can be exercised in tests against a LocalFileBackend without touching
+// the package-level config-derived backend.
+func retentionSweep(backend FileBackend, cutoff time.Time) (dirsPurged int, filesPurged int, bytesPurged int64, rerr *model.AppError) {
+	topLevel, err := backend.ListDirectory("")
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	cutoffPrefix := cutoff.Format(DATE_PREFIX_FORMAT)
+
+	for _, dir := range *topLevel {
+		if !datePrefixPattern.MatchString(dir) {
+			continue
+		}
+		if dir >= cutoffPrefix {
+			continue
+		}
+
+		files, listErr := backend.ListDirectoryRecursiveWithSizes(dir)
+		if listErr != nil {
+			return dirsPurged, filesPurged, bytesPurged, listErr
+		}
+
+		var dirBytes int64
+		for _, file := range *files {
+			dirBytes += file.Size
+		}
+
+		if removeErr := backend.RemoveDirectory(dir); removeErr != nil {
+			return dirsPurged, filesPurged, bytesPurged, removeErr
+		}
+
+		dirsPurged++
+		filesPurged += len(*files)
+		bytesPurged += dirBytes
+		l4g.Info("Retention sweep purged directory %v (%v files, %v bytes)", dir, len(*files), dirBytes)
+	}
+
+	return dirsPurged, filesPurged, bytesPurged, nil
+}
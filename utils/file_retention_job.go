@@ -0,0 +1,83 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import (
+	"sync"
+	"time"
+
+	l4g "github.com/alecthomas/log4go"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// retentionSweepInterval is how often RunRetentionJob checks whether a sweep
+// is due. Checking hourly (rather than sleeping until the next midnight)
+// keeps the job simple and tolerant of the process being restarted at an
+// arbitrary time.
+const retentionSweepInterval = time.Hour
+
+var (
+	retentionJobMut  sync.Mutex
+	retentionJobStop chan struct{}
+)
+
+// startOrStopRetentionJob starts RunRetentionJob in the background when fs
+// enables retention, and stops a previously started one when fs disables it
+// or changes RetentionDays. Called by SetFileSettings on every config save
+// so the job's lifecycle always matches the live config instead of needing
+// a separate scheduler to poll for the setting having changed.
+//
+// Like RetentionCutoff in file_retention.go, this depends on
+// FileSettings.RetentionDays existing on model.FileSettings, which it does
+// not yet in this tree.
+func startOrStopRetentionJob(fs model.FileSettings) {
+	retentionJobMut.Lock()
+	defer retentionJobMut.Unlock()
+
+	if retentionJobStop != nil {
+		close(retentionJobStop)
+		retentionJobStop = nil
+	}
+
+	if fs.RetentionDays != nil && *fs.RetentionDays > 0 {
+		stop := make(chan struct{})
+		retentionJobStop = stop
+		go RunRetentionJob(stop)
+	}
+}
+
+// RunRetentionJob runs the file retention sweep once a day for as long as
+// FileSettings.RetentionDays stays enabled, until stop is closed. Started
+// and stopped by startOrStopRetentionJob as FileSettings changes.
+func RunRetentionJob(stop <-chan struct{}) {
+	ticker := time.NewTicker(retentionSweepInterval)
+	defer ticker.Stop()
+
+	lastSwept := time.Time{}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			cutoff, enabled := RetentionCutoff()
+			if !enabled {
+				continue
+			}
+			if time.Since(lastSwept) < 24*time.Hour {
+				continue
+			}
+
+			dirsPurged, filesPurged, bytesPurged, err := RetentionSweep(cutoff)
+			if err != nil {
+				l4g.Error("File retention sweep failed: %v", err.Error())
+				continue
+			}
+
+			lastSwept = time.Now()
+			l4g.Info("File retention sweep complete: purged %v directories, %v files, %v bytes", dirsPurged, filesPurged, bytesPurged)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+func TestStartOrStopRetentionJob(t *testing.T) {
+	defer startOrStopRetentionJob(model.FileSettings{})
+
+	days := 30
+	startOrStopRetentionJob(model.FileSettings{RetentionDays: &days})
+
+	retentionJobMut.Lock()
+	running := retentionJobStop
+	retentionJobMut.Unlock()
+	if running == nil {
+		t.Fatal("expected a retention job to be running after enabling RetentionDays")
+	}
+
+	startOrStopRetentionJob(model.FileSettings{})
+
+	retentionJobMut.Lock()
+	stillRunning := retentionJobStop
+	retentionJobMut.Unlock()
+	if stillRunning != nil {
+		t.Fatal("expected the retention job to be stopped after RetentionDays is cleared")
+	}
+
+	select {
+	case <-running:
+	case <-time.After(time.Second):
+		t.Fatal("expected the stopped job's channel to be closed")
+	}
+}
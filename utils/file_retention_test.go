@@ -0,0 +1,94 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileUploadPath(t *testing.T) {
+	uploadedAt := time.Date(2018, time.March, 4, 12, 0, 0, 0, time.UTC)
+
+	got := FileUploadPath(uploadedAt, "teamid/channelid/userid/fileid/photo.png")
+	want := "20180304/teamid/channelid/userid/fileid/photo.png"
+
+	if got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestRetentionSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mm-file-retention-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := &LocalFileBackend{directory: dir}
+
+	now := time.Date(2018, time.March, 20, 12, 0, 0, 0, time.UTC)
+	cutoff := now.AddDate(0, 0, -30)
+
+	oldDir := cutoff.AddDate(0, 0, -1).Format(DATE_PREFIX_FORMAT)
+	newDir := now.Format(DATE_PREFIX_FORMAT)
+
+	write := func(relPath string, contents string) {
+		full := filepath.Join(dir, relPath)
+		if err := os.MkdirAll(filepath.Dir(full), 0774); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(full, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(oldDir+"/a.png", "aaaaa")
+	write(oldDir+"/sub/b.png", "bb")
+	write(newDir+"/c.png", "ccccccc")
+	write("not-a-date-dir/d.png", "dddd")
+
+	dirsPurged, filesPurged, bytesPurged, rerr := retentionSweep(backend, cutoff)
+	if rerr != nil {
+		t.Fatal(rerr)
+	}
+
+	if dirsPurged != 1 {
+		t.Fatalf("expected 1 directory purged, got %v", dirsPurged)
+	}
+	if filesPurged != 2 {
+		t.Fatalf("expected 2 files purged, got %v", filesPurged)
+	}
+	if bytesPurged != 7 {
+		t.Fatalf("expected 7 bytes purged, got %v", bytesPurged)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, oldDir)); !os.IsNotExist(err) {
+		t.Fatalf("expected %v to be removed", oldDir)
+	}
+	if _, err := os.Stat(filepath.Join(dir, newDir)); err != nil {
+		t.Fatalf("expected %v to still exist: %v", newDir, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "not-a-date-dir")); err != nil {
+		t.Fatalf("expected non-date directory to be left alone: %v", err)
+	}
+}
+
+func TestDatePrefixPattern(t *testing.T) {
+	cases := map[string]bool{
+		"20180304":  true,
+		"teams":     false,
+		"2018030":   false,
+		"201803045": false,
+	}
+
+	for in, want := range cases {
+		if got := datePrefixPattern.MatchString(in); got != want {
+			t.Fatalf("datePrefixPattern.MatchString(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
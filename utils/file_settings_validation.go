@@ -0,0 +1,125 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	s3 "github.com/minio/minio-go"
+	"github.com/minio/minio-go/pkg/credentials"
+
+	"github.com/mattermost/mattermost-server/model"
+)
+
+// AWS_S3_ENDPOINT_MAP maps well-known AWS S3 endpoints to their region, so
+// operators who leave AmazonS3Region blank still get a working client
+// instead of a confusing signature mismatch at first upload.
+var AWS_S3_ENDPOINT_MAP = map[string]string{
+	"s3.amazonaws.com":                "us-east-1",
+	"s3-external-1.amazonaws.com":     "us-east-1",
+	"s3-us-west-2.amazonaws.com":      "us-west-2",
+	"s3-us-west-1.amazonaws.com":      "us-west-1",
+	"s3-eu-west-1.amazonaws.com":      "eu-west-1",
+	"s3-eu-central-1.amazonaws.com":   "eu-central-1",
+	"s3-ap-southeast-1.amazonaws.com": "ap-southeast-1",
+	"s3-ap-southeast-2.amazonaws.com": "ap-southeast-2",
+	"s3-ap-northeast-1.amazonaws.com": "ap-northeast-1",
+	"s3-sa-east-1.amazonaws.com":      "sa-east-1",
+}
+
+// ValidateFileSettings does a best-effort pre-flight check of fs before the
+// server accepts it, so misconfiguration surfaces as an actionable error on
+// save rather than as a failure on the first upload. For drivers other than
+// S3 this is a no-op. Called by both TestFileConnection (the manual "Test
+// Connection" button) and SetFileSettings (the config-save path).
+func ValidateFileSettings(fs *model.FileSettings) (bool, *model.AppError) {
+	if *fs.DriverName != model.IMAGE_DRIVER_S3 {
+		return true, nil
+	}
+
+	endpoint := fs.AmazonS3Endpoint
+	if !isEndpointReachable(endpoint, *fs.AmazonS3SSL) {
+		return false, model.NewAppError("ValidateFileSettings", "utils.file.validate.s3.endpoint_unreachable.app_error", map[string]interface{}{"Endpoint": endpoint}, "", http.StatusBadRequest)
+	}
+
+	region := resolveS3Region(endpoint, fs.AmazonS3Region)
+
+	var creds *credentials.Credentials
+	if *fs.AmazonS3SignV2 {
+		creds = credentials.NewStatic(fs.AmazonS3AccessKeyId, fs.AmazonS3SecretAccessKey, "", credentials.SignatureV2)
+	} else {
+		creds = credentials.NewStatic(fs.AmazonS3AccessKeyId, fs.AmazonS3SecretAccessKey, "", credentials.SignatureV4)
+	}
+
+	s3Clnt, err := s3.NewWithCredentials(endpoint, creds, *fs.AmazonS3SSL, region)
+	if err != nil {
+		return false, model.NewAppError("ValidateFileSettings", "utils.file.validate.s3.connection.app_error", nil, err.Error(), http.StatusInternalServerError)
+	}
+
+	exists, err := s3Clnt.BucketExists(fs.AmazonS3Bucket)
+	if err != nil {
+		return false, model.NewAppError("ValidateFileSettings", "utils.file.validate.s3.invalid_signature.app_error", map[string]interface{}{"Bucket": fs.AmazonS3Bucket}, err.Error(), http.StatusBadRequest)
+	}
+	if !exists {
+		return false, model.NewAppError("ValidateFileSettings", "utils.file.validate.s3.bucket_not_found.app_error", map[string]interface{}{"Bucket": fs.AmazonS3Bucket}, "", http.StatusBadRequest)
+	}
+
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	count := 0
+	for object := range s3Clnt.ListObjects(fs.AmazonS3Bucket, "", false, doneCh) {
+		if object.Err != nil {
+			return false, model.NewAppError("ValidateFileSettings", "utils.file.validate.s3.permissions.app_error", map[string]interface{}{"Bucket": fs.AmazonS3Bucket}, object.Err.Error(), http.StatusBadRequest)
+		}
+		count++
+		if count >= 1 {
+			break
+		}
+	}
+
+	return true, nil
+}
+
+// resolveS3Region returns region if the operator set one explicitly,
+// otherwise looks up endpoint in AWS_S3_ENDPOINT_MAP. Falls back to an empty
+// region (minio's automatic region lookup) when the endpoint isn't a known
+// AWS one.
+func resolveS3Region(endpoint, region string) string {
+	if region != "" {
+		return region
+	}
+	return AWS_S3_ENDPOINT_MAP[endpoint]
+}
+
+// isEndpointReachable does a quick TCP dial to confirm the configured S3
+// endpoint resolves and accepts connections before we bother building a
+// client and making signed requests against it. secure should be
+// fs.AmazonS3SSL; it only matters when endpoint doesn't already include a
+// port, in which case it picks the right default (443 vs 80) instead of
+// always assuming HTTPS.
+func isEndpointReachable(endpoint string, secure bool) bool {
+	conn, err := net.DialTimeout("tcp", addrWithDefaultPort(endpoint, secure), 5*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// addrWithDefaultPort returns endpoint unchanged if it already has a port
+// (e.g. "minio:9000"), otherwise appends the default port for secure.
+func addrWithDefaultPort(endpoint string, secure bool) string {
+	if _, _, err := net.SplitHostPort(endpoint); err == nil {
+		return endpoint
+	}
+
+	defaultPort := "80"
+	if secure {
+		defaultPort = "443"
+	}
+	return net.JoinHostPort(endpoint, defaultPort)
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2017-present Mattermost, Inc. All Rights Reserved.
+// See License.txt for license information.
+
+package utils
+
+import "testing"
+
+func TestAddrWithDefaultPort(t *testing.T) {
+	cases := []struct {
+		name     string
+		endpoint string
+		secure   bool
+		want     string
+	}{
+		{"endpoint already has a port", "minio:9000", true, "minio:9000"},
+		{"endpoint already has a port, insecure", "minio:9000", false, "minio:9000"},
+		{"bare host, secure defaults to 443", "s3.amazonaws.com", true, "s3.amazonaws.com:443"},
+		{"bare host, insecure defaults to 80", "minio.example.com", false, "minio.example.com:80"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := addrWithDefaultPort(tc.endpoint, tc.secure); got != tc.want {
+				t.Fatalf("addrWithDefaultPort(%q, %v) = %q, want %q", tc.endpoint, tc.secure, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestResolveS3Region(t *testing.T) {
+	cases := []struct {
+		name     string
+		endpoint string
+		region   string
+		want     string
+	}{
+		{"explicit region wins", "s3.amazonaws.com", "eu-west-1", "eu-west-1"},
+		{"known endpoint maps to region", "s3-us-west-2.amazonaws.com", "", "us-west-2"},
+		{"unknown endpoint falls back to empty", "minio.example.com", "", ""},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := resolveS3Region(tc.endpoint, tc.region); got != tc.want {
+				t.Fatalf("resolveS3Region(%q, %q) = %q, want %q", tc.endpoint, tc.region, got, tc.want)
+			}
+		})
+	}
+}